@@ -0,0 +1,277 @@
+package localdriver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-incubator/localdriver/syncmap"
+)
+
+// DefaultBackendType is the backend used when a Create request doesn't
+// specify a "type" opt, and the backend LocalDriver falls back to for
+// volumes persisted before backends existed.
+const DefaultBackendType = "symlink"
+
+// Backend provisions, mounts, and destroys the on-disk storage for a single
+// volume. LocalDriver selects a Backend per volume from the "type" opt
+// passed to Create and persists that choice, so later Mount/Unmount/Remove
+// calls for the same volume route to the same Backend.
+type Backend interface {
+	Provision(logger lager.Logger, id string, opts map[string]interface{}) error
+	Mount(logger lager.Logger, id string, mountPath string) error
+	Unmount(logger lager.Logger, id string, mountPath string) error
+	Destroy(logger lager.Logger, id string) error
+	// Exists reports whether id still has the on-disk (or in-memory) state
+	// Provision created for it, so Restore can tell a genuinely orphaned
+	// volume from one whose backing storage just isn't a _volumes/ directory.
+	Exists(logger lager.Logger, id string) (bool, error)
+}
+
+// pathExists reports whether path exists on disk, using fileSystem rather
+// than the os package directly so it shares the fake-filesystem seam with
+// the rest of the driver.
+func pathExists(fileSystem FileSystem, path string) (bool, error) {
+	_, err := fileSystem.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+// newBackends builds the set of backends LocalDriver can select between,
+// keyed by the "type" opt value that selects them.
+func (d *LocalDriver) newBackends() map[string]Backend {
+	return map[string]Backend{
+		DefaultBackendType: &symlinkBackend{invoker: d.invoker, fileSystem: d.fileSystem, volumePath: d.volumePath},
+		"bind":             &bindBackend{invoker: d.invoker, fileSystem: d.fileSystem, volumePath: d.volumePath},
+		"tmpfs":            newTmpfsBackend(d.invoker, d.fileSystem),
+		"loopback":         &loopbackBackend{invoker: d.invoker, fileSystem: d.fileSystem, volumePath: d.volumePath},
+	}
+}
+
+// backendFor returns the Backend that was selected for volumeName at Create
+// time, falling back to DefaultBackendType for volumes persisted before a
+// backend type was recorded, or whose recorded type is no longer registered.
+func (d *LocalDriver) backendFor(volumeName string) Backend {
+	backendType, ok := d.backendTypes.Get(volumeName)
+	if !ok {
+		backendType = DefaultBackendType
+	}
+
+	if backend, ok := d.backends[backendType]; ok {
+		return backend
+	}
+
+	return d.backends[DefaultBackendType]
+}
+
+// symlinkBackend is the original localdriver behavior: a volume is just a
+// directory under _volumes/, and mounting it is a symlink into _mounts/.
+type symlinkBackend struct {
+	invoker    Invoker
+	fileSystem FileSystem
+	volumePath func(lager.Logger, string) string
+}
+
+func (b *symlinkBackend) Provision(logger lager.Logger, id string, opts map[string]interface{}) error {
+	return b.fileSystem.MkdirAll(b.volumePath(logger, id), os.ModePerm)
+}
+
+func (b *symlinkBackend) Mount(logger lager.Logger, id string, mountPath string) error {
+	volumePath := b.volumePath(logger, id)
+	logger.Info("link", lager.Data{"src": volumePath, "tgt": mountPath})
+	return b.invoker.Invoke(logger, "ln", []string{"-s", volumePath, mountPath})
+}
+
+func (b *symlinkBackend) Unmount(logger lager.Logger, id string, mountPath string) error {
+	return b.invoker.Invoke(logger, "rm", []string{mountPath})
+}
+
+func (b *symlinkBackend) Destroy(logger lager.Logger, id string) error {
+	return b.fileSystem.RemoveAll(b.volumePath(logger, id))
+}
+
+func (b *symlinkBackend) Exists(logger lager.Logger, id string) (bool, error) {
+	return pathExists(b.fileSystem, b.volumePath(logger, id))
+}
+
+// bindBackend mounts the volume's backing directory onto the mount path
+// with `mount --bind`, so writes through the mountpoint are visible at the
+// volume path and vice versa, without a symlink in between.
+type bindBackend struct {
+	invoker    Invoker
+	fileSystem FileSystem
+	volumePath func(lager.Logger, string) string
+}
+
+func (b *bindBackend) Provision(logger lager.Logger, id string, opts map[string]interface{}) error {
+	return b.fileSystem.MkdirAll(b.volumePath(logger, id), os.ModePerm)
+}
+
+func (b *bindBackend) Mount(logger lager.Logger, id string, mountPath string) error {
+	volumePath := b.volumePath(logger, id)
+	if err := b.fileSystem.MkdirAll(mountPath, os.ModePerm); err != nil {
+		return err
+	}
+	logger.Info("bind-mount", lager.Data{"src": volumePath, "tgt": mountPath})
+	return b.invoker.Invoke(logger, "mount", []string{"--bind", volumePath, mountPath})
+}
+
+func (b *bindBackend) Unmount(logger lager.Logger, id string, mountPath string) error {
+	if err := b.invoker.Invoke(logger, "umount", []string{mountPath}); err != nil {
+		return err
+	}
+	return b.fileSystem.RemoveAll(mountPath)
+}
+
+func (b *bindBackend) Destroy(logger lager.Logger, id string) error {
+	return b.fileSystem.RemoveAll(b.volumePath(logger, id))
+}
+
+func (b *bindBackend) Exists(logger lager.Logger, id string) (bool, error) {
+	return pathExists(b.fileSystem, b.volumePath(logger, id))
+}
+
+// tmpfsOpts is what Create's Opts tmpfs honors; it's captured at Provision
+// time so the later Mount (which the Backend interface gives no opts to)
+// can still pass them through to `mount`.
+type tmpfsOpts struct {
+	Size string
+	Mode string
+}
+
+// tmpfsBackend mounts an in-memory tmpfs filesystem directly onto the mount
+// path. It has nothing to provision ahead of time and nothing to destroy:
+// the filesystem disappears the moment it's unmounted.
+type tmpfsBackend struct {
+	invoker    Invoker
+	fileSystem FileSystem
+	opts       *syncmap.SyncMap[tmpfsOpts]
+}
+
+func newTmpfsBackend(invoker Invoker, fileSystem FileSystem) *tmpfsBackend {
+	return &tmpfsBackend{invoker: invoker, fileSystem: fileSystem, opts: syncmap.New[tmpfsOpts]()}
+}
+
+func (b *tmpfsBackend) Provision(logger lager.Logger, id string, opts map[string]interface{}) error {
+	var tOpts tmpfsOpts
+	if size, ok := opts["size"]; ok {
+		tOpts.Size = fmt.Sprintf("%v", size)
+	}
+	if mode, ok := opts["mode"]; ok {
+		tOpts.Mode = fmt.Sprintf("%v", mode)
+	}
+	b.opts.Put(id, tOpts)
+	return nil
+}
+
+func (b *tmpfsBackend) Mount(logger lager.Logger, id string, mountPath string) error {
+	if err := b.fileSystem.MkdirAll(mountPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	tOpts, _ := b.opts.Get(id)
+	var mountOpts []string
+	if tOpts.Size != "" {
+		mountOpts = append(mountOpts, fmt.Sprintf("size=%s", tOpts.Size))
+	}
+	if tOpts.Mode != "" {
+		mountOpts = append(mountOpts, fmt.Sprintf("mode=%s", tOpts.Mode))
+	}
+
+	args := []string{"-t", "tmpfs"}
+	if len(mountOpts) > 0 {
+		args = append(args, "-o", strings.Join(mountOpts, ","))
+	}
+	args = append(args, "tmpfs", mountPath)
+
+	logger.Info("tmpfs-mount", lager.Data{"tgt": mountPath, "opts": mountOpts})
+	return b.invoker.Invoke(logger, "mount", args)
+}
+
+func (b *tmpfsBackend) Unmount(logger lager.Logger, id string, mountPath string) error {
+	if err := b.invoker.Invoke(logger, "umount", []string{mountPath}); err != nil {
+		return err
+	}
+	return b.fileSystem.RemoveAll(mountPath)
+}
+
+func (b *tmpfsBackend) Destroy(logger lager.Logger, id string) error {
+	b.opts.Delete(id)
+	return nil
+}
+
+// Exists always reports true: a tmpfs volume has no on-disk artifact to
+// check for, and the only caller, Restore, only ever asks about ids it just
+// loaded from the persisted state file, so presence there already is the
+// existence check. b.opts can't substitute for it here - newBackends
+// recreates it empty on every restart and Restore does not repopulate it, so
+// a tmpfs volume restored from the state file mounts without size or mode.
+func (b *tmpfsBackend) Exists(logger lager.Logger, id string) (bool, error) {
+	return true, nil
+}
+
+// loopbackBackend provisions a sparse ext4 image file under _volumes/ and
+// mounts it via a loop device, so each volume gets real, kernel-enforced
+// size isolation instead of sharing the host filesystem.
+type loopbackBackend struct {
+	invoker    Invoker
+	fileSystem FileSystem
+	volumePath func(lager.Logger, string) string
+}
+
+func (b *loopbackBackend) imagePath(logger lager.Logger, id string) string {
+	return b.volumePath(logger, id) + ".img"
+}
+
+func (b *loopbackBackend) Provision(logger lager.Logger, id string, opts map[string]interface{}) error {
+	size, ok := opts["size"]
+	if !ok {
+		return errors.New("Missing mandatory 'size' opt for loopback volume")
+	}
+
+	imagePath := b.imagePath(logger, id)
+	if err := b.fileSystem.MkdirAll(filepath.Dir(imagePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	logger.Info("creating-loopback-image", lager.Data{"image": imagePath, "size": size})
+	if err := b.invoker.Invoke(logger, "truncate", []string{"-s", fmt.Sprintf("%v", size), imagePath}); err != nil {
+		return err
+	}
+
+	return b.invoker.Invoke(logger, "mkfs.ext4", []string{"-F", imagePath})
+}
+
+func (b *loopbackBackend) Mount(logger lager.Logger, id string, mountPath string) error {
+	imagePath := b.imagePath(logger, id)
+	if err := b.fileSystem.MkdirAll(mountPath, os.ModePerm); err != nil {
+		return err
+	}
+	logger.Info("loop-mount", lager.Data{"image": imagePath, "tgt": mountPath})
+	return b.invoker.Invoke(logger, "mount", []string{"-o", "loop", imagePath, mountPath})
+}
+
+func (b *loopbackBackend) Unmount(logger lager.Logger, id string, mountPath string) error {
+	if err := b.invoker.Invoke(logger, "umount", []string{mountPath}); err != nil {
+		return err
+	}
+	return b.fileSystem.RemoveAll(mountPath)
+}
+
+func (b *loopbackBackend) Destroy(logger lager.Logger, id string) error {
+	return b.fileSystem.Remove(b.imagePath(logger, id))
+}
+
+// Exists checks for the backing image file itself, since a loopback volume
+// has no _volumes/<id> directory the way symlink/bind volumes do.
+func (b *loopbackBackend) Exists(logger lager.Logger, id string) (bool, error) {
+	return pathExists(b.fileSystem, b.imagePath(logger, id))
+}
@@ -0,0 +1,16 @@
+package localdriver
+
+import "os"
+
+// FileSystem abstracts the filesystem calls LocalDriver and its backends
+// need, so tests can substitute a fake instead of touching disk.
+type FileSystem interface {
+	Abs(path string) (string, error)
+	MkdirAll(path string, perm os.FileMode) error
+	RemoveAll(path string) error
+	Remove(path string) error
+	Stat(path string) (os.FileInfo, error)
+	ReadFile(path string) ([]byte, error)
+	WriteFile(path string, data []byte, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+}
@@ -1,33 +1,164 @@
 package localdriver
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sync"
 
 	"strings"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-incubator/localdriver/syncmap"
 	"github.com/cloudfoundry-incubator/voldriver"
 	"path/filepath"
 )
 
 const VolumesRootDir = "_volumes"
 const MountsRootDir = "_mounts"
+const StateFileName = "state.json"
 
 type LocalDriver struct { // see voldriver.resources.go
-	volumes       map[string]*voldriver.VolumeInfo
-	fileSystem    FileSystem
-	invoker       Invoker
-	mountPathRoot string
+	volumes         *syncmap.SyncMap[voldriver.VolumeInfo]
+	mountIds        *syncmap.SyncMap[map[string]struct{}]
+	backendTypes    *syncmap.SyncMap[string]
+	mountCoordinate *syncmap.SyncMap[*volumeMountState]
+	backends        map[string]Backend
+	fileSystem      FileSystem
+	invoker         Invoker
+	mountPathRoot   string
 }
 
-func NewLocalDriver(fileSystem FileSystem, invoker Invoker, mountPathRoot string) *LocalDriver {
-	return &LocalDriver{
-		volumes:       map[string]*voldriver.VolumeInfo{},
-		fileSystem:    fileSystem,
-		invoker:       invoker,
-		mountPathRoot: mountPathRoot,
+func NewLocalDriver(logger lager.Logger, fileSystem FileSystem, invoker Invoker, mountPathRoot string) *LocalDriver {
+	d := &LocalDriver{
+		volumes:         syncmap.New[voldriver.VolumeInfo](),
+		mountIds:        syncmap.New[map[string]struct{}](),
+		backendTypes:    syncmap.New[string](),
+		mountCoordinate: syncmap.New[*volumeMountState](),
+		fileSystem:      fileSystem,
+		invoker:         invoker,
+		mountPathRoot:   mountPathRoot,
+	}
+	d.backends = d.newBackends()
+
+	d.Restore(logger)
+
+	return d
+}
+
+// Restore loads persisted volume state from the state file under
+// mountPathRoot, if any, resetting each entry's mount bookkeeping (a restart
+// implies no mounts survived it) and dropping any volume whose backend's
+// Exists reports its backing storage missing, or fails. It is exposed separately from
+// NewLocalDriver so tests and the binary's main can re-trigger reconciliation
+// on demand.
+func (d *LocalDriver) Restore(logger lager.Logger) error {
+	logger = logger.Session("restore")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	stateFile := d.stateFilePath(logger)
+
+	contents, err := d.fileSystem.ReadFile(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("no-state-file", lager.Data{"state_file": stateFile})
+			return nil
+		}
+		logger.Error("read-state-failed", err)
+		return err
+	}
+
+	var loaded persistedState
+	if err := json.Unmarshal(contents, &loaded); err != nil {
+		logger.Error("unmarshal-state-failed", err)
+		return err
+	}
+
+	for name, vol := range loaded.Volumes {
+		vol.MountCount = 0
+		vol.Mountpoint = ""
+
+		backendType, hasBackendType := loaded.BackendTypes[name]
+		if !hasBackendType {
+			backendType = DefaultBackendType
+		}
+		backend, ok := d.backends[backendType]
+		if !ok {
+			backend = d.backends[DefaultBackendType]
+		}
+
+		if exists, err := backend.Exists(logger, vol.Name); err != nil || !exists {
+			logger.Info("dropping-orphaned-volume", lager.Data{"volume_name": name, "volume_id": vol.Name})
+			continue
+		}
+
+		d.volumes.Put(name, vol)
+
+		if hasBackendType {
+			d.backendTypes.Put(name, backendType)
+		}
+	}
+
+	d.saveState(logger)
+
+	return nil
+}
+
+// persistedState is the on-disk shape of the state file: the volume map
+// plus the backend type recorded for each volume at Create time.
+type persistedState struct {
+	Volumes      map[string]voldriver.VolumeInfo `json:"volumes"`
+	BackendTypes map[string]string               `json:"backend_types"`
+}
+
+func (d *LocalDriver) stateFilePath(logger lager.Logger) string {
+	dir, err := d.fileSystem.Abs(d.mountPathRoot)
+	if err != nil {
+		logger.Fatal("abs-failed", err)
+	}
+
+	return filepath.Join(dir, StateFileName)
+}
+
+// saveState persists the current volume map to the state file, writing to a
+// temp file and renaming over the real path so a reader never observes a
+// partially-written state file.
+func (d *LocalDriver) saveState(logger lager.Logger) {
+	logger = logger.Session("save-state")
+
+	volumes, err := json.Marshal(d.volumes)
+	if err != nil {
+		logger.Error("marshal-state-failed", err)
+		return
+	}
+
+	backendTypes, err := json.Marshal(d.backendTypes)
+	if err != nil {
+		logger.Error("marshal-state-failed", err)
+		return
+	}
+
+	contents, err := json.Marshal(struct {
+		Volumes      json.RawMessage `json:"volumes"`
+		BackendTypes json.RawMessage `json:"backend_types"`
+	}{Volumes: volumes, BackendTypes: backendTypes})
+	if err != nil {
+		logger.Error("marshal-state-failed", err)
+		return
+	}
+
+	stateFile := d.stateFilePath(logger)
+	tmpFile := stateFile + ".tmp"
+
+	if err := d.fileSystem.WriteFile(tmpFile, contents, os.ModePerm); err != nil {
+		logger.Error("write-state-failed", err)
+		return
+	}
+
+	if err := d.fileSystem.Rename(tmpFile, stateFile); err != nil {
+		logger.Error("rename-state-failed", err)
 	}
 }
 
@@ -37,6 +168,10 @@ func (d *LocalDriver) Activate(logger lager.Logger) voldriver.ActivateResponse {
 	}
 }
 
+func (d *LocalDriver) Capabilities(logger lager.Logger) voldriver.CapabilitiesResponse {
+	return voldriver.CapabilitiesResponse{Scope: "local"}
+}
+
 func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.CreateRequest) voldriver.ErrorResponse {
 	logger = logger.Session("create")
 	var ok bool
@@ -51,14 +186,30 @@ func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.Create
 		return voldriver.ErrorResponse{Err: "Missing mandatory 'volume_id' field in 'Opts'"}
 	}
 
-	var existingVolume *voldriver.VolumeInfo
-	if existingVolume, ok = d.volumes[createRequest.Name]; !ok {
-		logger.Info("creating-volume", lager.Data{"volume_name": createRequest.Name, "volume_id": id.(string)})
-		d.volumes[createRequest.Name] = &voldriver.VolumeInfo{Name: id.(string)}
+	backendType := DefaultBackendType
+	if t, ok := createRequest.Opts["type"]; ok {
+		if ts, isString := t.(string); isString && ts != "" {
+			backendType = ts
+		}
+	}
+	backend, ok := d.backends[backendType]
+	if !ok {
+		logger.Info("unknown-backend-type", lager.Data{"type": backendType})
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Unknown volume backend type '%s'", backendType)}
+	}
+
+	var existingVolume voldriver.VolumeInfo
+	if existingVolume, ok = d.volumes.Get(createRequest.Name); !ok {
+		logger.Info("creating-volume", lager.Data{"volume_name": createRequest.Name, "volume_id": id.(string), "type": backendType})
+
+		if err := backend.Provision(logger, id.(string), createRequest.Opts); err != nil {
+			logger.Error("provision-volume-failed", err)
+			return voldriver.ErrorResponse{Err: fmt.Sprintf("Error provisioning volume: %s", err.Error())}
+		}
 
-		createDir := d.volumePath(logger, id.(string))
-		logger.Info("creating-volume-folder", lager.Data{"volume": createDir})
-		os.MkdirAll(createDir, os.ModePerm)
+		d.volumes.Put(createRequest.Name, voldriver.VolumeInfo{Name: id.(string)})
+		d.backendTypes.Put(createRequest.Name, backendType)
+		d.saveState(logger)
 
 		return voldriver.ErrorResponse{}
 	}
@@ -74,9 +225,10 @@ func (d *LocalDriver) Create(logger lager.Logger, createRequest voldriver.Create
 
 func (d *LocalDriver) List(logger lager.Logger) voldriver.ListResponse {
 	listResponse := voldriver.ListResponse{}
-	for _, volume := range d.volumes {
-		listResponse.Volumes = append(listResponse.Volumes, *volume)
-	}
+	d.volumes.Range(func(_ string, volume voldriver.VolumeInfo) bool {
+		listResponse.Volumes = append(listResponse.Volumes, volume)
+		return true
+	})
 	listResponse.Err = ""
 	return listResponse
 }
@@ -88,32 +240,122 @@ func (d *LocalDriver) Mount(logger lager.Logger, mountRequest voldriver.MountReq
 		return voldriver.MountResponse{Err: "Missing mandatory 'volume_name'"}
 	}
 
-	var vol *voldriver.VolumeInfo
-	var ok bool
-	if vol, ok = d.volumes[mountRequest.Name]; !ok {
+	vol, ok := d.volumes.Get(mountRequest.Name)
+	if !ok {
 		return voldriver.MountResponse{Err: fmt.Sprintf("Volume '%s' must be created before being mounted", mountRequest.Name)}
 	}
 
-	volumePath := d.volumePath(logger, vol.Name)
-
 	mountPath := d.mountPath(logger, vol.Name)
+
+	// decide: check-and-register the mount id under a single
+	// mountIds.Update, so two concurrent Mounts carrying the same ID can't
+	// both pass the dedupe check and each bump the mount count below.
+	var alreadyMounted bool
+	d.mountIds.Update(mountRequest.Name, func(ids map[string]struct{}, _ bool) map[string]struct{} {
+		if _, ok := ids[mountRequest.ID]; ok {
+			alreadyMounted = true
+			return ids
+		}
+		updated := copyMountIds(ids)
+		updated[mountRequest.ID] = struct{}{}
+		return updated
+	})
+
+	if alreadyMounted {
+		logger.Info("already-mounted", lager.Data{"id": mountRequest.ID})
+		vol, _ = d.volumes.Get(mountRequest.Name)
+		return voldriver.MountResponse{Mountpoint: vol.Mountpoint}
+	}
+
 	logger.Info("mounting-volume", lager.Data{"id": vol.Name, "mountpoint": mountPath})
 
-	err := d.mount(logger, volumePath, mountPath)
+	vol = d.volumes.Update(mountRequest.Name, func(v voldriver.VolumeInfo, _ bool) voldriver.VolumeInfo {
+		v.MountCount++
+		return v
+	})
+	d.saveState(logger)
+
+	// execute: concurrent Mounts for the same volume coalesce onto a single
+	// backend mount instead of racing each other, and with no lock held so a
+	// hung backend mount can't block any other volume operation
+	err := d.coordinateMount(logger, mountRequest.Name, vol.Name, mountPath)
 	if err != nil {
 		logger.Error("mount-volume-failed", err)
+		d.volumes.Update(mountRequest.Name, func(v voldriver.VolumeInfo, _ bool) voldriver.VolumeInfo {
+			v.MountCount--
+			return v
+		})
+		d.saveState(logger)
+		d.mountIds.Update(mountRequest.Name, func(ids map[string]struct{}, _ bool) map[string]struct{} {
+			reverted := copyMountIds(ids)
+			delete(reverted, mountRequest.ID)
+			return reverted
+		})
 		return voldriver.MountResponse{Err: fmt.Sprintf("Error mounting volume: %s", err.Error())}
 	}
 
-	vol.Mountpoint = mountPath
-
-	vol.MountCount++
+	vol = d.volumes.Update(mountRequest.Name, func(v voldriver.VolumeInfo, _ bool) voldriver.VolumeInfo {
+		v.Mountpoint = mountPath
+		return v
+	})
+	d.saveState(logger)
 	logger.Info("volume-mounted", lager.Data{"name": vol.Name, "count": vol.MountCount})
 
 	mountResponse := voldriver.MountResponse{Mountpoint: mountPath}
 	return mountResponse
 }
 
+// volumeMountState coordinates concurrent Mount calls for the same volume.
+// The first caller claims it via mountCoordinate.LoadOrStore, runs the
+// backend mount, and records the outcome in mountError before releasing wg;
+// every other concurrent caller waits on wg and replays that outcome instead
+// of invoking the backend mount a second time.
+type volumeMountState struct {
+	wg         sync.WaitGroup
+	mountError string
+}
+
+// coordinateMount ensures only one goroutine actually invokes the backend
+// mount for a given volume at a time. Concurrent callers block until that
+// mount completes and share its result, rather than each running their own
+// `ln`/`mount` against the same mountPath.
+func (d *LocalDriver) coordinateMount(logger lager.Logger, name string, volumeId string, mountPath string) error {
+	state := &volumeMountState{}
+	state.wg.Add(1)
+
+	leader, isLeader := d.mountCoordinate.LoadOrStore(name, state)
+	if !isLeader {
+		logger.Info("awaiting-in-flight-mount", lager.Data{"name": name})
+		leader.wg.Wait()
+		if leader.mountError != "" {
+			return errors.New(leader.mountError)
+		}
+		return nil
+	}
+
+	defer func() {
+		d.mountCoordinate.Delete(name)
+		state.wg.Done()
+	}()
+
+	if err := d.backendFor(name).Mount(logger, volumeId, mountPath); err != nil {
+		state.mountError = err.Error()
+		return err
+	}
+
+	return nil
+}
+
+// copyMountIds returns a new map holding the same entries as ids, so callers
+// never mutate a map that has already been stored in mountIds.
+func copyMountIds(ids map[string]struct{}) map[string]struct{} {
+	out := make(map[string]struct{}, len(ids))
+	for id := range ids {
+		out[id] = struct{}{}
+	}
+	return out
+}
+
 func (d *LocalDriver) Path(logger lager.Logger, pathRequest voldriver.PathRequest) voldriver.PathResponse {
 	logger = logger.Session("path", lager.Data{"volume": pathRequest.Name})
 
@@ -157,6 +399,26 @@ func (d *LocalDriver) Unmount(logger lager.Logger, unmountRequest voldriver.Unmo
 		return voldriver.ErrorResponse{Err: errText}
 	}
 
+	// decide: check-and-remove the mount id in a single mountIds.Update, so
+	// two concurrent Unmounts carrying the same ID can't both pass the
+	// "is it mounted" check and each proceed to decrement the mount count.
+	var wasMounted bool
+	d.mountIds.Update(unmountRequest.Name, func(ids map[string]struct{}, _ bool) map[string]struct{} {
+		if _, ok := ids[unmountRequest.ID]; !ok {
+			return ids
+		}
+		wasMounted = true
+		remaining := copyMountIds(ids)
+		delete(remaining, unmountRequest.ID)
+		return remaining
+	})
+
+	if !wasMounted {
+		errText := fmt.Sprintf("Volume '%s' is not mounted with id '%s'", unmountRequest.Name, unmountRequest.ID)
+		logger.Error("failed-mount-id-not-found", errors.New(errText))
+		return voldriver.ErrorResponse{Err: errText}
+	}
+
 	return d.unmount(logger, unmountRequest.Name, mountPath)
 }
 
@@ -170,9 +432,8 @@ func (d *LocalDriver) Remove(logger lager.Logger, removeRequest voldriver.Remove
 	}
 
 	var response voldriver.ErrorResponse
-	var vol *voldriver.VolumeInfo
-	var exists bool
-	if vol, exists = d.volumes[removeRequest.Name]; !exists {
+	vol, exists := d.volumes.Get(removeRequest.Name)
+	if !exists {
 		logger.Error("failed-volume-removal", fmt.Errorf(fmt.Sprintf("Volume %s not found", removeRequest.Name)))
 		return voldriver.ErrorResponse{fmt.Sprintf("Volume '%s' not found", removeRequest.Name)}
 	}
@@ -184,17 +445,17 @@ func (d *LocalDriver) Remove(logger lager.Logger, removeRequest voldriver.Remove
 		}
 	}
 
-	mountPath := d.volumePath(logger, vol.Name)
-
-	logger.Info("remove-volume-folder", lager.Data{"volume": mountPath})
-	err := d.fileSystem.RemoveAll(mountPath)
-	if err != nil {
+	logger.Info("remove-volume", lager.Data{"name": removeRequest.Name, "volume_id": vol.Name})
+	if err := d.backendFor(removeRequest.Name).Destroy(logger, vol.Name); err != nil {
 		logger.Error("failed-removing-volume", err)
 		return voldriver.ErrorResponse{Err: fmt.Sprintf("Failed removing mount path: %s", err)}
 	}
 
 	logger.Info("removing-volume", lager.Data{"name": removeRequest.Name})
-	delete(d.volumes, removeRequest.Name)
+	d.volumes.Delete(removeRequest.Name)
+	d.mountIds.Delete(removeRequest.Name)
+	d.backendTypes.Delete(removeRequest.Name)
+	d.saveState(logger)
 	return voldriver.ErrorResponse{}
 }
 
@@ -208,7 +469,7 @@ func (d *LocalDriver) Get(logger lager.Logger, getRequest voldriver.GetRequest)
 }
 
 func (d *LocalDriver) get(logger lager.Logger, volumeName string) (string, error) {
-	if vol, ok := d.volumes[volumeName]; ok {
+	if vol, ok := d.volumes.Get(volumeName); ok {
 		logger.Info("getting-volume", lager.Data{"name": volumeName})
 		return vol.Mountpoint, nil
 	}
@@ -255,12 +516,6 @@ func (d *LocalDriver) volumePath(logger lager.Logger, volumeId string) string {
 	return filepath.Join(volumesPathRoot, volumeId)
 }
 
-func (d *LocalDriver) mount(logger lager.Logger, volumePath, mountPath string) error {
-	logger.Info("link", lager.Data{"src": volumePath, "tgt": mountPath})
-	args := []string{"-s", volumePath, mountPath}
-	return d.invoker.Invoke(logger, "ln", args)
-}
-
 func (d *LocalDriver) unmount(logger lager.Logger, name string, mountPath string) voldriver.ErrorResponse {
 	logger = logger.Session("unmount")
 	logger.Info("start")
@@ -278,23 +533,43 @@ func (d *LocalDriver) unmount(logger lager.Logger, name string, mountPath string
 		return voldriver.ErrorResponse{Err: errText}
 	}
 
-	d.volumes[name].MountCount--
-	if d.volumes[name].MountCount > 0 {
-		logger.Info("volume-still-in-use", lager.Data{"name": name, "count": d.volumes[name].MountCount})
+	// decide: account for the unmount before doing any slow work, so a
+	// concurrent Mount/Unmount sees the decremented count rather than
+	// racing on it
+	vol, stillInUse := d.decrementMountCount(logger, name)
+	if stillInUse {
+		logger.Info("volume-still-in-use", lager.Data{"name": name, "count": vol.MountCount})
 		return voldriver.ErrorResponse{}
-	} else {
-		logger.Info("unmount-volume-folder", lager.Data{"mountpath": mountPath})
-		args := []string{mountPath}
-		err := d.invoker.Invoke(logger, "rm", args)
-		if err != nil {
-			logger.Error("unmount-failed", err)
-			return voldriver.ErrorResponse{Err: fmt.Sprintf("Error mounting volume: %s", err.Error())}
-		}
+	}
+
+	// execute: the actual unmount happens with no lock held, so a hung backend
+	// unmount can't block any other volume operation
+	logger.Info("unmount-volume-folder", lager.Data{"mountpath": mountPath})
+	err = d.backendFor(name).Unmount(logger, vol.Name, mountPath)
+	if err != nil {
+		logger.Error("unmount-failed", err)
+		return voldriver.ErrorResponse{Err: fmt.Sprintf("Error mounting volume: %s", err.Error())}
 	}
 
 	logger.Info("unmounted-volume")
 
-	d.volumes[name].Mountpoint = ""
+	d.volumes.Update(name, func(v voldriver.VolumeInfo, _ bool) voldriver.VolumeInfo {
+		v.Mountpoint = ""
+		return v
+	})
+	d.saveState(logger)
 
 	return voldriver.ErrorResponse{}
 }
+
+// decrementMountCount decrements the mount count for name and stores the
+// result, returning the updated volume and whether it is still in use by
+// another mount.
+func (d *LocalDriver) decrementMountCount(logger lager.Logger, name string) (voldriver.VolumeInfo, bool) {
+	vol := d.volumes.Update(name, func(v voldriver.VolumeInfo, _ bool) voldriver.VolumeInfo {
+		v.MountCount--
+		return v
+	})
+	d.saveState(logger)
+	return vol, vol.MountCount > 0
+}
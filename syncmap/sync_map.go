@@ -0,0 +1,94 @@
+package syncmap
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// SyncMap is a concurrency-safe string-keyed map guarded by a single
+// RWMutex. Get returns a copy of the stored value, so when V is a value type
+// (not a pointer, map or slice) every update must go through Put or Update;
+// a caller can then never hold a reference into the map and mutate it
+// without the lock.
+type SyncMap[V any] struct {
+	mu   sync.RWMutex
+	data map[string]V
+}
+
+// New returns an empty SyncMap.
+func New[V any]() *SyncMap[V] {
+	return &SyncMap[V]{
+		data: map[string]V{},
+	}
+}
+
+// Get returns the value stored under key, and whether it was present.
+func (m *SyncMap[V]) Get(key string) (V, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	v, ok := m.data[key]
+	return v, ok
+}
+
+// Put stores value under key, replacing any existing entry.
+func (m *SyncMap[V]) Put(key string, value V) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = value
+}
+
+// LoadOrStore returns the existing value for key if present; otherwise it
+// stores value and returns it. The returned bool is true when value was the
+// one stored (i.e. the caller is the first to claim key).
+func (m *SyncMap[V]) LoadOrStore(key string, value V) (V, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.data[key]; ok {
+		return existing, false
+	}
+	m.data[key] = value
+	return value, true
+}
+
+// Update atomically reads the current value for key (and whether it was
+// present), applies f, stores the result, and returns it. Unlike a Get
+// followed by a Put, the read, mutation, and write all happen under a single
+// lock acquisition, so two concurrent Updates for the same key can never
+// both read the same starting value and clobber each other's write.
+func (m *SyncMap[V]) Update(key string, f func(value V, ok bool) V) V {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.data[key]
+	updated := f(existing, ok)
+	m.data[key] = updated
+	return updated
+}
+
+// Delete removes key from the map, if present.
+func (m *SyncMap[V]) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+}
+
+// Range calls f for every entry in the map. f should not call back into the
+// same SyncMap, since Range holds the read lock for its duration. Iteration
+// stops early if f returns false.
+func (m *SyncMap[V]) Range(f func(key string, value V) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, v := range m.data {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// MarshalJSON snapshots the map under the read lock and marshals it as a
+// plain JSON object, so the map can be persisted or logged like any other
+// value.
+func (m *SyncMap[V]) MarshalJSON() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return json.Marshal(m.data)
+}